@@ -0,0 +1,217 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// CertCache abstracts where a client's certificate, key, and trusted CA bundle come
+// from, mirroring the way autocert.Manager layers caching behind its Cache interface.
+// The default DirCache reads from disk; other implementations (in-memory for tests,
+// Vault-KV for the Vault backend) plug in without touching the HTTP client code.
+type CertCache interface {
+	// Get returns the current client certificate and CA pool.
+	Get(ctx context.Context) (tls.Certificate, *x509.CertPool, error)
+	// Put installs a new PEM-encoded client certificate and key, e.g. after the
+	// CertRenewer issues one.
+	Put(ctx context.Context, certPEM, keyPEM []byte) error
+	// Watch returns a channel that receives a value whenever the underlying
+	// certificate material changes. It is closed if the cache cannot watch for
+	// changes; callers should treat a closed channel like one that never fires.
+	Watch() <-chan struct{}
+}
+
+// DirCache is a CertCache that reads a cert/key pair and CA bundle from fixed paths on
+// disk. It does not itself detect changes; Watch never fires. Use FileWatchCache to
+// additionally pick up changes made by an external process (e.g. cert-manager or the
+// CertRenewer) without restarting keysync.
+type DirCache struct {
+	CertFile string
+	KeyFile  string
+	CaBundle string
+}
+
+// Get loads the certificate, key, and CA bundle from disk.
+func (d DirCache) Get(ctx context.Context) (tls.Certificate, *x509.CertPool, error) {
+	keyPair, err := tls.LoadX509KeyPair(d.CertFile, d.KeyFile)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("Error loading Keypair '%s'/'%s': %v", d.CertFile, d.KeyFile, err)
+	}
+
+	caCert, err := ioutil.ReadFile(d.CaBundle)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("Error loading CA file '%s': %v", d.CaBundle, err)
+	}
+	caCertPool := x509.NewCertPool()
+	caCertPool.AppendCertsFromPEM(caCert)
+
+	return keyPair, caCertPool, nil
+}
+
+// Put atomically writes certPEM and keyPEM to CertFile and KeyFile.
+func (d DirCache) Put(ctx context.Context, certPEM, keyPEM []byte) error {
+	if err := writeFileAtomically(d.CertFile, certPEM, 0644); err != nil {
+		return fmt.Errorf("writing %s: %v", d.CertFile, err)
+	}
+	if err := writeFileAtomically(d.KeyFile, keyPEM, 0600); err != nil {
+		return fmt.Errorf("writing %s: %v", d.KeyFile, err)
+	}
+	return nil
+}
+
+// Watch returns a closed channel, since DirCache has no way to detect out-of-band
+// changes to the files it reads.
+func (d DirCache) Watch() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+// writeFileAtomically writes data to a temp file in the same directory as path and then
+// renames it into place, so readers never observe a partially-written certificate.
+func writeFileAtomically(path string, data []byte, mode os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// FileWatchCache wraps a DirCache with an fsnotify watch on CertFile, KeyFile, and
+// CaBundle, firing Watch() whenever any of them change on disk. This lets operators
+// rotate certificates by simply replacing the files, without keysync polling
+// RebuildClient on a timer.
+type FileWatchCache struct {
+	DirCache
+
+	logger  *logrus.Entry
+	watcher *fsnotify.Watcher
+	changes chan struct{}
+}
+
+// NewFileWatchCache builds a FileWatchCache and starts watching CertFile, KeyFile, and
+// CaBundle for changes.
+func NewFileWatchCache(certFile, keyFile, caBundle string, logger *logrus.Entry) (*FileWatchCache, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("creating fsnotify watcher: %v", err)
+	}
+
+	for _, f := range []string{certFile, keyFile, caBundle} {
+		if err := watcher.Add(f); err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("watching '%s': %v", f, err)
+		}
+	}
+
+	c := &FileWatchCache{
+		DirCache: DirCache{CertFile: certFile, KeyFile: keyFile, CaBundle: caBundle},
+		logger:   logger.WithField("logger", "cert_cache"),
+		watcher:  watcher,
+		changes:  make(chan struct{}, 1),
+	}
+	go c.run()
+	return c, nil
+}
+
+func (c *FileWatchCache) run() {
+	for {
+		select {
+		case event, ok := <-c.watcher.Events:
+			if !ok {
+				close(c.changes)
+				return
+			}
+			// Editors and atomic-rename-based writers (as used by the CertRenewer)
+			// generate Remove/Rename/Create events rather than a plain Write, so
+			// treat any event on a watched file as a potential rotation.
+			c.logger.WithField("event", event).Info("Certificate material changed on disk")
+			select {
+			case c.changes <- struct{}{}:
+			default:
+				// a notification is already pending; no need to queue another
+			}
+			// Atomic renames replace the watched inode, so the watch on the old
+			// inode needs to be re-added to keep receiving further events.
+			if err := c.watcher.Add(event.Name); err != nil {
+				c.logger.WithError(err).Warnf("Error re-adding watch for '%s'", event.Name)
+			}
+		case err, ok := <-c.watcher.Errors:
+			if !ok {
+				return
+			}
+			c.logger.WithError(err).Warn("Error watching certificate files")
+		}
+	}
+}
+
+// Watch returns a channel that receives a value whenever CertFile, KeyFile, or
+// CaBundle change on disk.
+func (c *FileWatchCache) Watch() <-chan struct{} {
+	return c.changes
+}
+
+// Close stops watching the underlying files.
+func (c *FileWatchCache) Close() error {
+	return c.watcher.Close()
+}
+
+// closeCertCache closes cache's background filesystem watch, if it has one (e.g.
+// FileWatchCache); a CertCache that doesn't need closing (e.g. DirCache) is left alone.
+func closeCertCache(cache CertCache) error {
+	closer, ok := cache.(interface{ Close() error })
+	if !ok {
+		return nil
+	}
+	return closer.Close()
+}
+
+// watchCertCache starts a background goroutine that calls target.RebuildClient
+// whenever cache reports a change, so operators no longer need to call RebuildClient
+// on a timer. Shared by both KeywhizHTTPClient and VaultClient.
+func watchCertCache(cache CertCache, target certRebuilder, logger *logrus.Entry) {
+	go func() {
+		for range cache.Watch() {
+			if err := target.RebuildClient(); err != nil {
+				logger.WithError(err).Error("Error rebuilding client after certificate rotation")
+			} else {
+				logger.Info("Rebuilt client after certificate rotation")
+			}
+		}
+	}()
+}
@@ -0,0 +1,241 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// renewalFraction is how far into a certificate's lifetime the renewer requests a
+// replacement, mirroring the 2/3-of-lifetime strategy used by golang.org/x/crypto/acme/autocert.
+const renewalFraction = 2.0 / 3.0
+
+// renewalJitter bounds how much the computed renewal deadline is randomly shifted, so
+// that a fleet of keysync instances sharing a role don't all hit Vault's PKI endpoint
+// at the same instant.
+const renewalJitter = 1 * time.Minute
+
+// certRebuilder is satisfied by any client (KeywhizHTTPClient, VaultClient) whose HTTP
+// transport needs to be rebuilt after a renewed certificate lands on disk.
+type certRebuilder interface {
+	RebuildClient() error
+}
+
+// certClientProvider is satisfied by a target that, in addition to rebuilding its own
+// HTTP transport, can hand back the Vault client currently in use. CertRenewer asks for
+// it on every renew() rather than caching one, since RebuildClient (e.g. after the
+// renewer's own previous renewal) replaces the target's client out from under it.
+type certClientProvider interface {
+	certRebuilder
+	vaultClient() *vaultapi.Client
+}
+
+// CertRenewer periodically issues a fresh client certificate/key pair from a Vault PKI
+// secrets engine and installs them for use by a keysync client, removing the need for
+// an external process to manage short-lived certs on disk.
+type CertRenewer struct {
+	logger *logrus.Entry
+	target certClientProvider
+
+	pkiMount string
+	role     string
+	cache    CertCache
+
+	expiresAt     metrics.Gauge
+	renewalsTotal metrics.Counter
+
+	stop chan struct{}
+	done chan struct{}
+
+	mu        sync.Mutex
+	leaseID   string
+	leaseDone bool
+}
+
+// NewCertRenewer builds a CertRenewer that keeps cache populated with certificates
+// issued by Vault's pki/issue/<role> endpoint, installing each renewed keypair via
+// cache.Put and then calling target.RebuildClient so it picks up the new keypair.
+func NewCertRenewer(pkiMount, role string, cache CertCache, target certClientProvider, logger *logrus.Entry, registry metrics.Registry) *CertRenewer {
+	return &CertRenewer{
+		logger:        logger.WithField("logger", "cert_renewer"),
+		target:        target,
+		pkiMount:      pkiMount,
+		role:          role,
+		cache:         cache,
+		expiresAt:     metrics.GetOrRegisterGauge("cert.expires_at", registry),
+		renewalsTotal: metrics.GetOrRegisterCounter("cert.renewals_total", registry),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+// Start issues an initial certificate if the cache doesn't already have one and then
+// runs the renewal loop in a background goroutine until Stop is called.
+func (r *CertRenewer) Start() error {
+	if _, _, err := r.cache.Get(context.Background()); err != nil {
+		if err := r.renew(); err != nil {
+			return fmt.Errorf("issuing initial certificate: %v", err)
+		}
+	}
+
+	go r.loop()
+	return nil
+}
+
+// Stop halts the renewal loop and revokes the most recently issued certificate's lease.
+func (r *CertRenewer) Stop() {
+	close(r.stop)
+	<-r.done
+	r.revokeLease()
+}
+
+func (r *CertRenewer) loop() {
+	defer close(r.done)
+
+	deadline, err := r.nextDeadline()
+	if err != nil {
+		r.logger.WithError(err).Warn("Unable to determine certificate renewal deadline, falling back to on-disk cert")
+		deadline = time.Now().Add(renewalFraction * 24 * time.Hour)
+	}
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-time.After(time.Until(deadline)):
+			if err := r.renew(); err != nil {
+				r.logger.WithError(err).Error("Error renewing certificate, retrying on-disk cert is still in use")
+				deadline = time.Now().Add(time.Minute)
+				continue
+			}
+			next, err := r.nextDeadline()
+			if err != nil {
+				r.logger.WithError(err).Warn("Unable to determine next renewal deadline")
+				deadline = time.Now().Add(renewalFraction * 24 * time.Hour)
+				continue
+			}
+			deadline = next
+		}
+	}
+}
+
+// nextDeadline reads the current certificate from the cache and computes the point 2/3 of
+// the way from its NotBefore to its NotAfter, with jitter applied.
+func (r *CertRenewer) nextDeadline() (time.Time, error) {
+	tlsCert, _, err := r.cache.Get(context.Background())
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(tlsCert.Certificate) == 0 {
+		return time.Time{}, fmt.Errorf("certificate cache returned no certificate")
+	}
+	cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing certificate: %v", err)
+	}
+
+	r.expiresAt.Update(cert.NotAfter.Unix())
+
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	renewAt := cert.NotBefore.Add(time.Duration(float64(lifetime) * renewalFraction))
+
+	jitter := time.Duration(rand.Int63n(int64(renewalJitter))) - renewalJitter/2
+	return renewAt.Add(jitter), nil
+}
+
+// renew issues a new certificate from Vault and atomically installs it, then rebuilds
+// the target client's HTTP transport so subsequent requests use the new keypair. The
+// certificate being replaced is only revoked once the new one is safely in place, so a
+// failed or unreachable Vault leaves the on-disk cert (and its lease) usable.
+func (r *CertRenewer) renew() error {
+	secret, err := r.target.vaultClient().Logical().Write(
+		fmt.Sprintf("%s/issue/%s", r.pkiMount, r.role),
+		map[string]interface{}{
+			"common_name": r.role,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("vault pki issue: %v", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return fmt.Errorf("vault pki issue: empty response")
+	}
+
+	certificate, ok := secret.Data["certificate"].(string)
+	if !ok {
+		return fmt.Errorf("vault pki issue: response missing 'certificate'")
+	}
+	privateKey, ok := secret.Data["private_key"].(string)
+	if !ok {
+		return fmt.Errorf("vault pki issue: response missing 'private_key'")
+	}
+
+	if err := r.cache.Put(context.Background(), []byte(certificate), []byte(privateKey)); err != nil {
+		return fmt.Errorf("installing renewed certificate: %v", err)
+	}
+
+	r.mu.Lock()
+	previousLeaseID := r.leaseID
+	r.leaseID = secret.LeaseID
+	r.leaseDone = false
+	r.mu.Unlock()
+
+	if err := r.target.RebuildClient(); err != nil {
+		return fmt.Errorf("rebuilding client with renewed cert: %v", err)
+	}
+
+	// Only now that the new cert is on disk and in use do we revoke the one it
+	// superseded.
+	r.revokeLeaseID(previousLeaseID)
+
+	r.renewalsTotal.Inc(1)
+	r.logger.Info("Renewed client certificate from Vault PKI")
+	return nil
+}
+
+// revokeLease revokes the lease on the most recently issued certificate, if any. It is
+// used on shutdown; renew revokes superseded leases itself via revokeLeaseID.
+func (r *CertRenewer) revokeLease() {
+	r.mu.Lock()
+	leaseID := r.leaseID
+	alreadyDone := r.leaseDone
+	r.leaseDone = true
+	r.mu.Unlock()
+
+	if alreadyDone {
+		return
+	}
+	r.revokeLeaseID(leaseID)
+}
+
+// revokeLeaseID revokes a specific Vault lease, logging (rather than failing) on error
+// since a revoke failure shouldn't block certificate renewal or shutdown.
+func (r *CertRenewer) revokeLeaseID(leaseID string) {
+	if leaseID == "" {
+		return
+	}
+	if err := r.target.vaultClient().Sys().Revoke(leaseID); err != nil {
+		r.logger.WithError(err).Warn("Error revoking certificate lease")
+	}
+}
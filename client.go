@@ -16,8 +16,8 @@ package keysync
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -43,13 +43,19 @@ var ciphers = []uint16{
 	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
 }
 
-// Client represents an interface to a secrets storage backend.
+// Client represents an interface to a secrets storage backend. ctx carries a
+// per-call deadline and is canceled on shutdown, so a stuck backend request
+// cannot block shutdown or wedge the whole sync pass.
 type Client interface {
-	Secret(name string) (secret *Secret, err error)
-	SecretList() (map[string]Secret, error)
-	SecretListWithContents(secrets []string) (map[string]Secret, error)
+	Secret(ctx context.Context, name string) (secret *Secret, err error)
+	SecretList(ctx context.Context) (map[string]Secret, error)
+	SecretListWithContents(ctx context.Context, secrets []string) (map[string]Secret, error)
 	Logger() *logrus.Entry
 	RebuildClient() error
+	// Close releases any background resources the client holds, e.g. a CertRenewer
+	// or a CertCache's filesystem watch, and revokes any cert lease still
+	// outstanding. Callers should call it once when shutting down.
+	Close() error
 }
 
 // KeywhizHTTPClient is a client that reads from a Keywhiz server over HTTP (v2 API).
@@ -60,6 +66,8 @@ type KeywhizHTTPClient struct {
 	params      httpClientParams
 	failCount   metrics.Counter
 	lastSuccess metrics.Gauge
+	signer      *jwsSigner
+	nonces      *nonceCache
 }
 
 // httpClientParams are values necessary for constructing a TLS client.
@@ -67,12 +75,64 @@ type httpClientParams struct {
 	CertFile   string `json:"cert_file"`
 	KeyFile    string `json:"key_file"`
 	CaBundle   string `json:"ca_bundle"`
+	cache      CertCache
 	timeout    time.Duration
 	maxRetries int
 	minBackoff time.Duration
 	maxBackoff time.Duration
 }
 
+// buildHTTPClientParams parses cfg's timeout and backoff settings and builds the
+// CertCache and httpClientParams shared by both NewClient and NewVaultClient. It
+// returns the CertCache separately from params so callers can pass it to
+// watchCertCache without reaching into params.cache.
+func buildHTTPClientParams(cfg *ClientConfig, caFile string, logger *logrus.Entry) (httpClientParams, CertCache, error) {
+	timeout, err := time.ParseDuration(cfg.Timeout)
+	if err != nil {
+		return httpClientParams{}, nil, fmt.Errorf("bad timeout value '%s': %+v", cfg.Timeout, err)
+	}
+
+	minBackoff, err := time.ParseDuration(cfg.MinBackoff)
+	if err != nil {
+		return httpClientParams{}, nil, fmt.Errorf("bad min backoff value '%s': %+v", cfg.MinBackoff, err)
+	}
+
+	maxBackoff, err := time.ParseDuration(cfg.MaxBackoff)
+	if err != nil {
+		return httpClientParams{}, nil, fmt.Errorf("bad max backoff value '%s': %+v", cfg.MaxBackoff, err)
+	}
+
+	cache, err := NewFileWatchCache(cfg.Cert, cfg.Key, caFile, logger)
+	if err != nil {
+		logger.WithError(err).Warn("Unable to watch certificate files for changes, falling back to manual RebuildClient")
+		cache = nil
+	}
+	var certCache CertCache = DirCache{CertFile: cfg.Cert, KeyFile: cfg.Key, CaBundle: caFile}
+	if cache != nil {
+		certCache = cache
+	}
+
+	params := httpClientParams{
+		CertFile:   cfg.Cert,
+		KeyFile:    cfg.Key,
+		CaBundle:   caFile,
+		cache:      certCache,
+		timeout:    timeout,
+		maxRetries: int(cfg.MaxRetries),
+		minBackoff: minBackoff,
+		maxBackoff: maxBackoff,
+	}
+	return params, certCache, nil
+}
+
+// buildServerMetrics registers (or reuses) the runtime.server.* metrics shared by both
+// the Keywhiz and Vault clients.
+func buildServerMetrics(registry metrics.Registry) (metrics.Counter, metrics.Gauge) {
+	failCount := metrics.GetOrRegisterCounter("runtime.server.fails", registry)
+	lastSuccess := metrics.GetOrRegisterGauge("runtime.server.lastsuccess", registry)
+	return failCount, lastSuccess
+}
+
 // SecretDeleted is returned as an error when the server 404s.
 type SecretDeleted struct{}
 
@@ -95,48 +155,49 @@ func (c KeywhizHTTPClient) Logger() *logrus.Entry {
 }
 
 // NewClient produces a ready-to-use client struct given client config and
-// CA file with the list of trusted certificate authorities.
+// CA file with the list of trusted certificate authorities. The concrete
+// implementation is selected by cfg.Backend ("keywhiz", the default, or "vault").
 func NewClient(cfg *ClientConfig, caFile string, serverURL *url.URL, logger *logrus.Entry, metricsHandle *sqmetrics.SquareMetrics) (client Client, err error) {
-	logger = logger.WithField("logger", "kwfs_client")
-
-	timeout, err := time.ParseDuration(cfg.Timeout)
-	if err != nil {
-		return &KeywhizHTTPClient{}, fmt.Errorf("bad timeout value '%s': %+v", cfg.Timeout, err)
+	switch cfg.Backend {
+	case "", backendKeywhiz:
+		// fall through to the Keywhiz HTTP client below
+	case backendVault:
+		return NewVaultClient(cfg, caFile, serverURL, logger, metricsHandle)
+	default:
+		return nil, fmt.Errorf("unknown client backend '%s'", cfg.Backend)
 	}
 
-	minBackoff, err := time.ParseDuration(cfg.MinBackoff)
-	if err != nil {
-		return &KeywhizHTTPClient{}, fmt.Errorf("bad min backoff value '%s': %+v", cfg.MinBackoff, err)
-	}
+	logger = logger.WithField("logger", "kwfs_client")
 
-	maxBackoff, err := time.ParseDuration(cfg.MaxBackoff)
+	params, certCache, err := buildHTTPClientParams(cfg, caFile, logger)
 	if err != nil {
-		return &KeywhizHTTPClient{}, fmt.Errorf("bad max backoff value '%s': %+v", cfg.MaxBackoff, err)
-	}
-
-	params := httpClientParams{
-		CertFile:   cfg.Cert,
-		KeyFile:    cfg.Key,
-		CaBundle:   caFile,
-		timeout:    timeout,
-		maxRetries: int(cfg.MaxRetries),
-		minBackoff: minBackoff,
-		maxBackoff: maxBackoff,
+		return &KeywhizHTTPClient{}, err
 	}
 
-	failCount := metrics.GetOrRegisterCounter("runtime.server.fails", metricsHandle.Registry)
-	lastSuccess := metrics.GetOrRegisterGauge("runtime.server.lastsuccess", metricsHandle.Registry)
+	failCount, lastSuccess := buildServerMetrics(metricsHandle.Registry)
 
 	initial, err := params.buildClient()
 	if err != nil {
 		return &KeywhizHTTPClient{}, err
 	}
 
-	return &KeywhizHTTPClient{logger, initial, serverURL, params, failCount, lastSuccess}, nil
+	var signer *jwsSigner
+	if cfg.SigningKey != "" {
+		signer, err = newJWSSigner(cfg.SigningKey, cfg.SigningKeyID)
+		if err != nil {
+			return &KeywhizHTTPClient{}, fmt.Errorf("configuring request signing: %v", err)
+		}
+	}
+
+	kwClient := &KeywhizHTTPClient{logger, initial, serverURL, params, failCount, lastSuccess, signer, &nonceCache{}}
+	watchCertCache(certCache, kwClient, logger)
+	return kwClient, nil
 }
 
-// RebuildClient reloads certificates from disk.  It should be called periodically to ensure up-to-date client
-// certificates are used.  This is important if you're using short-lived certificates that are routinely replaced.
+// RebuildClient reloads the certificate, key, and CA bundle from the configured
+// CertCache and swaps in a new *http.Client built from them. It should be called
+// whenever the underlying material changes; watchCertCache does this automatically
+// for CertCache implementations that support it (e.g. FileWatchCache).
 func (c *KeywhizHTTPClient) RebuildClient() error {
 	client, err := c.params.buildClient()
 	if err != nil {
@@ -146,12 +207,17 @@ func (c *KeywhizHTTPClient) RebuildClient() error {
 	return nil
 }
 
+// Close releases the CertCache's background filesystem watch, if any.
+func (c KeywhizHTTPClient) Close() error {
+	return closeCertCache(c.params.cache)
+}
+
 // ServerStatus returns raw JSON from the server's _status endpoint
-func (c KeywhizHTTPClient) ServerStatus() (data []byte, err error) {
+func (c KeywhizHTTPClient) ServerStatus(ctx context.Context) (data []byte, err error) {
 	path := "_status"
 	logger := c.logger.WithField("logger", path)
 	now := time.Now()
-	resp, err := c.getWithRetry(path)
+	resp, err := c.getWithRetry(ctx, path)
 	if err != nil {
 		logger.WithError(err).Warn("Error retrieving server status")
 		return nil, err
@@ -172,10 +238,10 @@ func (c KeywhizHTTPClient) ServerStatus() (data []byte, err error) {
 }
 
 // RawSecret returns raw JSON from requesting a secret.
-func (c KeywhizHTTPClient) RawSecret(name string) ([]byte, error) {
+func (c KeywhizHTTPClient) RawSecret(ctx context.Context, name string) ([]byte, error) {
 	// note: path.Join does not know how to properly escape for URLs!
 	pathname := path.Join("secret", name)
-	data, statusCode, err := c.queryKeywhizWithRetries(pathname, fmt.Sprintf("secret %s", name))
+	data, statusCode, err := c.queryKeywhizWithRetries(ctx, pathname, fmt.Sprintf("secret %s", name))
 	if err != nil {
 		c.logger.Errorf("Error querying Keywhiz for secret %v: %v", name, err)
 		c.failCountInc()
@@ -198,8 +264,8 @@ func (c KeywhizHTTPClient) RawSecret(name string) ([]byte, error) {
 }
 
 // Secret returns an unmarshalled Secret struct after requesting a secret.
-func (c KeywhizHTTPClient) Secret(name string) (secret *Secret, err error) {
-	data, err := c.RawSecret(name)
+func (c KeywhizHTTPClient) Secret(ctx context.Context, name string) (secret *Secret, err error) {
+	data, err := c.RawSecret(ctx, name)
 	if err != nil {
 		return nil, err
 	}
@@ -213,8 +279,8 @@ func (c KeywhizHTTPClient) Secret(name string) (secret *Secret, err error) {
 }
 
 // RawSecretList returns raw JSON from requesting a listing of secrets.
-func (c KeywhizHTTPClient) RawSecretList() ([]byte, error) {
-	data, statusCode, err := c.queryKeywhizWithRetries("secrets", "secrets without contents")
+func (c KeywhizHTTPClient) RawSecretList(ctx context.Context) ([]byte, error) {
+	data, statusCode, err := c.queryKeywhizWithRetries(ctx, "secrets", "secrets without contents")
 
 	if err != nil {
 		c.failCountInc()
@@ -230,8 +296,8 @@ func (c KeywhizHTTPClient) RawSecretList() ([]byte, error) {
 
 // SecretList returns a map of unmarshalled Secret structs without their contents after requesting a listing of secrets.
 // The map keys are the names of the secrets
-func (c KeywhizHTTPClient) SecretList() (map[string]Secret, error) {
-	data, err := c.RawSecretList()
+func (c KeywhizHTTPClient) SecretList(ctx context.Context) (map[string]Secret, error) {
+	data, err := c.RawSecretList(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -239,7 +305,7 @@ func (c KeywhizHTTPClient) SecretList() (map[string]Secret, error) {
 }
 
 // RawSecretListWithContents returns raw JSON from requesting a listing of secrets with their contents.
-func (c KeywhizHTTPClient) RawSecretListWithContents(secrets []string) ([]byte, error) {
+func (c KeywhizHTTPClient) RawSecretListWithContents(ctx context.Context, secrets []string) ([]byte, error) {
 	pathname := "batchsecret"
 
 	req, err := json.Marshal(map[string][]string{
@@ -252,7 +318,7 @@ func (c KeywhizHTTPClient) RawSecretListWithContents(secrets []string) ([]byte,
 	}
 
 	now := time.Now()
-	resp, err := c.postWithRetry(pathname, "application/json", bytes.NewBuffer(req))
+	resp, err := c.postMaybeSignedWithRetry(ctx, pathname, req)
 	if err != nil {
 		c.failCountInc()
 		c.logger.Errorf("Error retrieving secrets with contents: %v", err)
@@ -277,8 +343,8 @@ func (c KeywhizHTTPClient) RawSecretListWithContents(secrets []string) ([]byte,
 // SecretList returns a map of unmarshalled Secret structs, including their contents, associated with the
 // given list of secrets. The map keys are the names of the secrets. All secrets must be accessible to this
 // client, or the entire request will fail.
-func (c KeywhizHTTPClient) SecretListWithContents(secrets []string) (map[string]Secret, error) {
-	data, err := c.RawSecretListWithContents(secrets)
+func (c KeywhizHTTPClient) SecretListWithContents(ctx context.Context, secrets []string) (map[string]Secret, error) {
+	data, err := c.RawSecretListWithContents(ctx, secrets)
 	if err != nil {
 		return nil, err
 	}
@@ -306,9 +372,9 @@ func (c KeywhizHTTPClient) processSecretList(data []byte) (map[string]Secret, er
 	return secretMap, nil
 }
 
-func (c KeywhizHTTPClient) queryKeywhizWithRetries(pathname, goalForMsg string) (result []byte, status int, err error) {
+func (c KeywhizHTTPClient) queryKeywhizWithRetries(ctx context.Context, pathname, goalForMsg string) (result []byte, status int, err error) {
 	now := time.Now()
-	resp, err := c.getWithRetry(pathname)
+	resp, err := c.getWithRetry(ctx, pathname)
 	if err != nil {
 		c.logger.Errorf("Error retrieving %v: %v", goalForMsg, err)
 		return nil, -1, err
@@ -324,19 +390,19 @@ func (c KeywhizHTTPClient) queryKeywhizWithRetries(pathname, goalForMsg string)
 	return data, resp.StatusCode, err
 }
 
-// buildClient constructs a new TLS client.
+// buildClient constructs a new TLS client, loading the certificate, key, and CA bundle
+// from p.cache (falling back to a plain DirCache over p.CertFile/KeyFile/CaBundle if
+// none was configured).
 func (p httpClientParams) buildClient() (*http.Client, error) {
-	keyPair, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
-	if err != nil {
-		return nil, fmt.Errorf("Error loading Keypair '%s'/'%s': %v", p.CertFile, p.KeyFile, err)
+	cache := p.cache
+	if cache == nil {
+		cache = DirCache{CertFile: p.CertFile, KeyFile: p.KeyFile, CaBundle: p.CaBundle}
 	}
 
-	caCert, err := ioutil.ReadFile(p.CaBundle)
+	keyPair, caCertPool, err := cache.Get(context.Background())
 	if err != nil {
-		return nil, fmt.Errorf("Error loading CA file '%s': %v", p.CaBundle, err)
+		return nil, err
 	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
 
 	config := &tls.Config{
 		Certificates: []tls.Certificate{keyPair},
@@ -356,8 +422,9 @@ func shouldRetry(resp *http.Response) bool {
 }
 
 // getWithRetry encapsulates the retry logic for requests that failed, because of
-// intermittent issues
-func (c *KeywhizHTTPClient) getWithRetry(url string) (resp *http.Response, err error) {
+// intermittent issues. It honors ctx.Err() between retries so a canceled or expired
+// context aborts the loop instead of sleeping through it.
+func (c *KeywhizHTTPClient) getWithRetry(ctx context.Context, url string) (resp *http.Response, err error) {
 	t := *c.url
 	t.Path = path.Join(c.url.Path, url)
 
@@ -369,23 +436,34 @@ func (c *KeywhizHTTPClient) getWithRetry(url string) (resp *http.Response, err e
 	}
 
 	for i := 0; i < c.params.maxRetries; i++ {
+		req, reqErr := http.NewRequestWithContext(ctx, http.MethodGet, t.String(), nil)
+		if reqErr != nil {
+			return nil, reqErr
+		}
+
 		now := time.Now()
-		resp, err = c.httpClient.Get(t.String())
+		resp, err = c.httpClient.Do(req)
 		if err != nil || !shouldRetry(resp) {
 			return
 		}
+
 		sleep := b.Duration()
 		c.logger.Infof("GET /%s %d %v, attempt %d out of %d, retry in %v\n", url, resp.StatusCode, time.Since(now), i+1, c.params.maxRetries, sleep)
 
-		time.Sleep(sleep)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(sleep):
+		}
 	}
 
 	return
 }
 
 // postWithRetry encapsulates the retry logic for requests that failed, because of
-// intermittent issues
-func (c *KeywhizHTTPClient) postWithRetry(url, contentType string, body io.Reader) (resp *http.Response, err error) {
+// intermittent issues. It honors ctx.Err() between retries so a canceled or expired
+// context aborts the loop instead of sleeping through it.
+func (c *KeywhizHTTPClient) postWithRetry(ctx context.Context, url, contentType string, body io.Reader) (resp *http.Response, err error) {
 	t := *c.url
 	t.Path = path.Join(c.url.Path, url)
 
@@ -397,16 +475,97 @@ func (c *KeywhizHTTPClient) postWithRetry(url, contentType string, body io.Reade
 	}
 
 	for i := 0; i < c.params.maxRetries; i++ {
+		req, reqErr := http.NewRequestWithContext(ctx, http.MethodPost, t.String(), body)
+		if reqErr != nil {
+			return nil, reqErr
+		}
+		req.Header.Set("Content-Type", contentType)
+
 		now := time.Now()
-		resp, err = c.httpClient.Post(t.String(), contentType, body)
+		resp, err = c.httpClient.Do(req)
+		if resp != nil {
+			c.nonces.push(resp.Header.Get("Replay-Nonce"))
+		}
 		if err != nil || !shouldRetry(resp) {
 			return
 		}
+
 		sleep := b.Duration()
 		c.logger.Infof("POST /%s %d %v, attempt %d out of %d, retry in %v\n", url, resp.StatusCode, time.Since(now), i+1, c.params.maxRetries, sleep)
 
-		time.Sleep(sleep)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(sleep):
+		}
 	}
 
 	return
 }
+
+// nextNonce returns a nonce to use for a signed request, reusing one cached from a
+// previous response's Replay-Nonce header if available, or fetching a fresh one from
+// the /nonce endpoint otherwise.
+func (c *KeywhizHTTPClient) nextNonce(ctx context.Context) (string, error) {
+	if nonce, ok := c.nonces.pop(); ok {
+		return nonce, nil
+	}
+
+	t := *c.url
+	t.Path = path.Join(c.url.Path, "nonce")
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, t.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetching nonce: %v", err)
+	}
+	defer resp.Body.Close()
+
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", fmt.Errorf("fetching nonce: response missing Replay-Nonce header")
+	}
+	return nonce, nil
+}
+
+// postMaybeSignedWithRetry POSTs payload as a plain JSON body, or as a flattened JWS if
+// c.signer is configured, retrying once on a rejected nonce.
+func (c *KeywhizHTTPClient) postMaybeSignedWithRetry(ctx context.Context, pathname string, payload []byte) (*http.Response, error) {
+	if c.signer == nil {
+		return c.postWithRetry(ctx, pathname, "application/json", bytes.NewBuffer(payload))
+	}
+
+	t := *c.url
+	t.Path = path.Join(c.url.Path, pathname)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		nonce, err := c.nextNonce(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		signed, err := c.signer.sign(t.String(), nonce, payload)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.postWithRetry(ctx, pathname, "application/jose+json", bytes.NewReader(signed))
+		if err != nil {
+			return nil, err
+		}
+		bad, err := isBadNonce(resp)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if bad && attempt == 0 {
+			resp.Body.Close()
+			continue
+		}
+		return resp, nil
+	}
+
+	return nil, fmt.Errorf("exhausted retries signing request to %s", pathname)
+}
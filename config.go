@@ -0,0 +1,62 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+// ClientConfig configures how keysync talks to its secrets storage backend.
+type ClientConfig struct {
+	Timeout    string `json:"timeout"`
+	MinBackoff string `json:"min_backoff"`
+	MaxBackoff string `json:"max_backoff"`
+	MaxRetries uint   `json:"max_retries"`
+	Cert       string `json:"cert"`
+	Key        string `json:"key"`
+
+	// Backend selects the Client implementation NewClient constructs: "keywhiz"
+	// (the default, for backward compatibility with configs that omit it) or
+	// "vault". See vault_client.go.
+	Backend string `json:"backend"`
+
+	// VaultAddr, VaultNamespace, and VaultMount locate the Vault server and KV v2
+	// mount to read secrets from when Backend is "vault".
+	VaultAddr      string `json:"vault_addr"`
+	VaultNamespace string `json:"vault_namespace"`
+	VaultMount     string `json:"vault_mount"`
+
+	// VaultAuthMethod selects how to authenticate to Vault: "token" (the default,
+	// reading VaultTokenFile), "approle" (VaultRoleID/VaultSecretID), or
+	// "kubernetes" (VaultRole/VaultJWTFile). VaultAuthMount overrides the mount
+	// path of the approle/kubernetes auth method, defaulting to the method name.
+	VaultAuthMethod string `json:"vault_auth_method"`
+	VaultAuthMount  string `json:"vault_auth_mount"`
+	VaultTokenFile  string `json:"vault_token_file"`
+	VaultRoleID     string `json:"vault_role_id"`
+	VaultSecretID   string `json:"vault_secret_id"`
+	VaultRole       string `json:"vault_role"`
+	VaultJWTFile    string `json:"vault_jwt_file"`
+
+	// VaultPKIMount and VaultPKIRole configure the CertRenewer, which keeps Cert/Key
+	// populated with certificates issued by Vault's PKI secrets engine. Leave
+	// VaultPKIMount empty to manage Cert/Key by some other means, as keysync has
+	// always supported.
+	VaultPKIMount string `json:"vault_pki_mount"`
+	VaultPKIRole  string `json:"vault_pki_role"`
+
+	// SigningKey, if set, is the path to a PEM-encoded PKCS#8 Ed25519 or ECDSA P-256
+	// private key used to JWS-sign outbound POST bodies (see jws.go). SigningKeyID is the
+	// "kid" advertised in the protected header so the server can pick the right
+	// verification key. Leave SigningKey empty to disable request signing.
+	SigningKey   string `json:"signing_key"`
+	SigningKeyID string `json:"signing_key_id"`
+}
@@ -0,0 +1,199 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// nonceRingSize bounds how many unused Replay-Nonce values postMaybeSignedWithRetry will keep around
+// from previous responses before falling back to a fresh HEAD /nonce request.
+const nonceRingSize = 8
+
+// nonceCache is a small ring buffer of server-issued nonces, so a signed POST can reuse
+// the Replay-Nonce header from a previous response instead of round-tripping to the
+// /nonce endpoint every time, mirroring how ACME clients manage their nonce pool.
+type nonceCache struct {
+	mu     sync.Mutex
+	nonces []string
+}
+
+func (n *nonceCache) push(nonce string) {
+	if nonce == "" {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.nonces) >= nonceRingSize {
+		n.nonces = n.nonces[1:]
+	}
+	n.nonces = append(n.nonces, nonce)
+}
+
+func (n *nonceCache) pop() (string, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.nonces) == 0 {
+		return "", false
+	}
+	nonce := n.nonces[len(n.nonces)-1]
+	n.nonces = n.nonces[:len(n.nonces)-1]
+	return nonce, true
+}
+
+// jwsSigner signs outbound request bodies with an Ed25519 or ECDSA P-256 key configured
+// alongside the client's mTLS certificate, giving Keywhiz operators a second,
+// application-layer proof of client identity for high-value batch reads.
+type jwsSigner struct {
+	signer crypto.Signer
+	alg    string
+	kid    string
+}
+
+// newJWSSigner loads a PEM-encoded PKCS#8 Ed25519 or ECDSA P-256 private key from
+// keyFile and returns a signer that identifies itself with kid in the protected header.
+func newJWSSigner(keyFile, kid string) (*jwsSigner, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading signing key '%s': %v", keyFile, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in signing key '%s'", keyFile)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing signing key '%s': %v", keyFile, err)
+	}
+
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return &jwsSigner{signer: k, alg: "EdDSA", kid: kid}, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve.Params().BitSize != 256 {
+			return nil, fmt.Errorf("signing key '%s': only P-256 ECDSA keys are supported", keyFile)
+		}
+		return &jwsSigner{signer: k, alg: "ES256", kid: kid}, nil
+	default:
+		return nil, fmt.Errorf("signing key '%s': unsupported key type %T", keyFile, key)
+	}
+}
+
+// flattenedJWS is the flattened JWS JSON serialization (RFC 7515 section 7.2.2).
+type flattenedJWS struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// sign produces the flattened JWS JSON serialization of payload, with the protected
+// header carrying alg, kid, nonce, and url, mirroring the request-signing discipline
+// ACME clients use.
+func (s *jwsSigner) sign(url, nonce string, payload []byte) ([]byte, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg":   s.alg,
+		"kid":   s.kid,
+		"nonce": nonce,
+		"url":   url,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	protected := base64.RawURLEncoding.EncodeToString(header)
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	signingInput := protected + "." + encodedPayload
+
+	sig, err := s.signRaw([]byte(signingInput))
+	if err != nil {
+		return nil, fmt.Errorf("signing request: %v", err)
+	}
+
+	return json.Marshal(flattenedJWS{
+		Protected: protected,
+		Payload:   encodedPayload,
+		Signature: base64.RawURLEncoding.EncodeToString(sig),
+	})
+}
+
+// signRaw signs data (hashing it with SHA-256 first, for ECDSA) with the configured key, producing a raw (R||S, for ECDSA)
+// signature as expected by JWS rather than the ASN.1 DER encoding crypto/ecdsa.Sign
+// would otherwise produce.
+func (s *jwsSigner) signRaw(data []byte) ([]byte, error) {
+	switch key := s.signer.(type) {
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, data), nil
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(data)
+		r, sVal, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		out := make([]byte, 2*size)
+		r.FillBytes(out[:size])
+		sVal.FillBytes(out[size:])
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported signer type %T", s.signer)
+	}
+}
+
+// badNonceErrorType is the "type" a conforming server returns in its JSON problem body
+// for a stale or unknown nonce, mirroring ACME's urn:ietf:params:acme:error:badNonce.
+const badNonceErrorType = "badNonce"
+
+// jwsErrorBody is the JSON problem body a server is expected to return alongside a 400
+// response to a JWS-signed request, so the client can distinguish a rejected nonce
+// (worth retrying once with a fresh one) from any other failure.
+type jwsErrorBody struct {
+	Type string `json:"type"`
+}
+
+// isBadNonce reports whether resp represents a rejected-nonce error, so the caller can
+// fetch a fresh nonce and retry once rather than giving up. It consumes and replaces
+// resp.Body so callers can still read it afterwards.
+func isBadNonce(resp *http.Response) (bool, error) {
+	if resp == nil || resp.StatusCode != http.StatusBadRequest {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return false, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	var body jwsErrorBody
+	if err := json.Unmarshal(data, &body); err != nil {
+		// Not our JSON problem format; treat as a generic (non-nonce) failure.
+		return false, nil
+	}
+	return body.Type == badNonceErrorType, nil
+}
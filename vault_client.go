@@ -0,0 +1,424 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	pkgerr "github.com/pkg/errors"
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	sqmetrics "github.com/square/go-sq-metrics"
+)
+
+// Backend names recognized by the "backend" field in a client config.  Keywhiz is the
+// default so existing configs without a "backend" field keep working unmodified.
+const (
+	backendKeywhiz = "keywhiz"
+	backendVault   = "vault"
+)
+
+// vaultAuthMethod is implemented by each supported way of authenticating to Vault.
+type vaultAuthMethod interface {
+	// login exchanges whatever credential this method holds for a Vault client token.
+	login(client *vaultapi.Client) (token string, err error)
+}
+
+// tokenFileAuth reads a Vault token from a file on disk, re-reading it on every login so
+// that an externally-rotated token (e.g. by a sidecar) is picked up automatically.
+type tokenFileAuth struct {
+	path string
+}
+
+func (a tokenFileAuth) login(client *vaultapi.Client) (string, error) {
+	data, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return "", fmt.Errorf("reading vault token file '%s': %v", a.path, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// approleAuth authenticates via Vault's AppRole auth method.
+type approleAuth struct {
+	mount    string
+	roleID   string
+	secretID string
+}
+
+func (a approleAuth) login(client *vaultapi.Client) (string, error) {
+	mount := a.mount
+	if mount == "" {
+		mount = "approle"
+	}
+	secret, err := client.Logical().Write(path.Join("auth", mount, "login"), map[string]interface{}{
+		"role_id":   a.roleID,
+		"secret_id": a.secretID,
+	})
+	if err != nil {
+		return "", fmt.Errorf("vault approle login: %v", err)
+	}
+	if secret == nil || secret.Auth == nil {
+		return "", fmt.Errorf("vault approle login: empty auth response")
+	}
+	return secret.Auth.ClientToken, nil
+}
+
+// kubernetesAuth authenticates via Vault's Kubernetes auth method, using the service
+// account JWT mounted into the pod.
+type kubernetesAuth struct {
+	mount   string
+	role    string
+	jwtFile string
+}
+
+func (a kubernetesAuth) login(client *vaultapi.Client) (string, error) {
+	mount := a.mount
+	if mount == "" {
+		mount = "kubernetes"
+	}
+	jwt, err := ioutil.ReadFile(a.jwtFile)
+	if err != nil {
+		return "", fmt.Errorf("reading kubernetes jwt '%s': %v", a.jwtFile, err)
+	}
+	secret, err := client.Logical().Write(path.Join("auth", mount, "login"), map[string]interface{}{
+		"role": a.role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("vault kubernetes login: %v", err)
+	}
+	if secret == nil || secret.Auth == nil {
+		return "", fmt.Errorf("vault kubernetes login: empty auth response")
+	}
+	return secret.Auth.ClientToken, nil
+}
+
+// VaultClient is a client that reads secrets from a HashiCorp Vault KV v2 mount, for
+// deployments migrating off a Keywhiz server while keeping the rest of keysync unchanged.
+type VaultClient struct {
+	logger *logrus.Entry
+
+	// mu guards client, since RebuildClient replaces it with a freshly built
+	// *vaultapi.Client after a certificate rotation while Secret/SecretList may be
+	// reading it concurrently from another goroutine.
+	mu          sync.RWMutex
+	client      *vaultapi.Client
+	auth        vaultAuthMethod
+	mount       string
+	params      httpClientParams
+	failCount   metrics.Counter
+	lastSuccess metrics.Gauge
+	certRenewer *CertRenewer
+}
+
+// NewVaultClient produces a ready-to-use Vault-backed client given client config and CA
+// file with the list of trusted certificate authorities.
+func NewVaultClient(cfg *ClientConfig, caFile string, serverURL *url.URL, logger *logrus.Entry, metricsHandle *sqmetrics.SquareMetrics) (client Client, err error) {
+	logger = logger.WithField("logger", "vault_client")
+
+	params, certCache, err := buildHTTPClientParams(cfg, caFile, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, err := params.buildClient()
+	if err != nil {
+		return nil, err
+	}
+
+	vconfig := vaultapi.DefaultConfig()
+	vconfig.Address = cfg.VaultAddr
+	vconfig.HttpClient = httpClient
+
+	vclient, err := vaultapi.NewClient(vconfig)
+	if err != nil {
+		return nil, fmt.Errorf("building vault client: %v", err)
+	}
+	if cfg.VaultNamespace != "" {
+		vclient.SetNamespace(cfg.VaultNamespace)
+	}
+
+	auth, err := buildVaultAuth(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	failCount, lastSuccess := buildServerMetrics(metricsHandle.Registry)
+
+	vc := &VaultClient{
+		logger:      logger,
+		client:      vclient,
+		auth:        auth,
+		mount:       cfg.VaultMount,
+		params:      params,
+		failCount:   failCount,
+		lastSuccess: lastSuccess,
+	}
+
+	if err := vc.authenticate(); err != nil {
+		return nil, err
+	}
+
+	watchCertCache(certCache, vc, logger)
+
+	if cfg.VaultPKIMount != "" {
+		renewer := NewCertRenewer(cfg.VaultPKIMount, cfg.VaultPKIRole, certCache, vc, logger, metricsHandle.Registry)
+		if err := renewer.Start(); err != nil {
+			return nil, fmt.Errorf("starting certificate renewer: %v", err)
+		}
+		vc.certRenewer = renewer
+	}
+
+	return vc, nil
+}
+
+// buildVaultAuth selects an auth method implementation from the client config.
+func buildVaultAuth(cfg *ClientConfig) (vaultAuthMethod, error) {
+	switch cfg.VaultAuthMethod {
+	case "", "token":
+		if cfg.VaultTokenFile == "" {
+			return nil, fmt.Errorf("vault auth method 'token' requires vault_token_file")
+		}
+		return tokenFileAuth{path: cfg.VaultTokenFile}, nil
+	case "approle":
+		if cfg.VaultRoleID == "" || cfg.VaultSecretID == "" {
+			return nil, fmt.Errorf("vault auth method 'approle' requires vault_role_id and vault_secret_id")
+		}
+		return approleAuth{mount: cfg.VaultAuthMount, roleID: cfg.VaultRoleID, secretID: cfg.VaultSecretID}, nil
+	case "kubernetes":
+		if cfg.VaultRole == "" {
+			return nil, fmt.Errorf("vault auth method 'kubernetes' requires vault_role")
+		}
+		jwtFile := cfg.VaultJWTFile
+		if jwtFile == "" {
+			jwtFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+		}
+		return kubernetesAuth{mount: cfg.VaultAuthMount, role: cfg.VaultRole, jwtFile: jwtFile}, nil
+	default:
+		return nil, fmt.Errorf("unknown vault auth method '%s'", cfg.VaultAuthMethod)
+	}
+}
+
+// vaultClient returns the *vaultapi.Client currently in use, synchronized against
+// concurrent replacement by RebuildClient.
+func (c *VaultClient) vaultClient() *vaultapi.Client {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.client
+}
+
+func (c *VaultClient) authenticate() error {
+	client := c.vaultClient()
+	token, err := c.auth.login(client)
+	if err != nil {
+		return err
+	}
+	client.SetToken(token)
+	return nil
+}
+
+func (c *VaultClient) failCountInc() {
+	c.failCount.Inc(1)
+}
+
+func (c *VaultClient) markSuccess() {
+	c.failCount.Clear()
+	c.lastSuccess.Update(time.Now().Unix())
+}
+
+// Logger returns the underlying logger for this client
+func (c *VaultClient) Logger() *logrus.Entry {
+	return c.logger
+}
+
+// RebuildClient reloads certificates from disk and re-authenticates against Vault.  It
+// should be called periodically, e.g. if Vault-issued client certs are short-lived.
+func (c *VaultClient) RebuildClient() error {
+	httpClient, err := c.params.buildClient()
+	if err != nil {
+		return err
+	}
+
+	current := c.vaultClient()
+	vconfig := current.CloneConfig()
+	vconfig.HttpClient = httpClient
+	vclient, err := vaultapi.NewClient(vconfig)
+	if err != nil {
+		return fmt.Errorf("rebuilding vault client: %v", err)
+	}
+	vclient.SetToken(current.Token())
+
+	c.mu.Lock()
+	c.client = vclient
+	c.mu.Unlock()
+
+	return c.authenticate()
+}
+
+// Close stops the certificate renewer, if one is running, revoking its most recently
+// issued certificate's lease, and closes the CertCache's background filesystem watch.
+func (c *VaultClient) Close() error {
+	if c.certRenewer != nil {
+		c.certRenewer.Stop()
+	}
+	return closeCertCache(c.params.cache)
+}
+
+// dataPath returns the KV v2 "data" path for a secret name.
+func (c *VaultClient) dataPath(name string) string {
+	return path.Join(c.mount, "data", name)
+}
+
+// metadataPath returns the KV v2 "metadata" path for a secret name.
+func (c *VaultClient) metadataPath(name string) string {
+	return path.Join(c.mount, "metadata", name)
+}
+
+// Secret returns an unmarshalled Secret struct after requesting a secret from Vault.
+func (c *VaultClient) Secret(ctx context.Context, name string) (secret *Secret, err error) {
+	resp, err := c.vaultClient().Logical().ReadWithContext(ctx, c.dataPath(name))
+	if err != nil {
+		c.failCountInc()
+		c.logger.Errorf("Error querying Vault for secret %v: %v", name, err)
+		return nil, err
+	}
+	if resp == nil || vaultSecretSoftDeleted(resp) {
+		c.logger.Warnf("Secret %v not found", name)
+		return nil, SecretDeleted{}
+	}
+
+	s, err := secretFromVaultResponse(name, resp)
+	if err != nil {
+		return nil, pkgerr.Wrapf(err, "decoding secret %v from vault", name)
+	}
+	c.markSuccess()
+	return s, nil
+}
+
+// SecretList returns a map of unmarshalled Secret structs, including their contents, by
+// listing the metadata paths under the configured mount and reading each listed secret.
+func (c *VaultClient) SecretList(ctx context.Context) (map[string]Secret, error) {
+	resp, err := c.vaultClient().Logical().ListWithContext(ctx, c.metadataPath(""))
+	if err != nil {
+		c.failCountInc()
+		return nil, fmt.Errorf("error querying Vault for secret list: %v", err)
+	}
+
+	names, err := vaultListKeys(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.SecretListWithContents(ctx, names)
+}
+
+// SecretListWithContents returns a map of unmarshalled Secret structs, including their
+// contents, for the given list of secret names. The map keys are the names of the secrets.
+func (c *VaultClient) SecretListWithContents(ctx context.Context, secrets []string) (map[string]Secret, error) {
+	secretMap := map[string]Secret{}
+	for _, name := range secrets {
+		secret, err := c.Secret(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		filename, err := secret.Filename()
+		if err != nil {
+			return nil, pkgerr.Wrap(err, "unable to get secret's filename")
+		}
+		if duplicate, ok := secretMap[filename]; ok {
+			return nil, fmt.Errorf("duplicate filename detected: %s on secrets %s and %s",
+				filename, duplicate.Name, secret.Name)
+		}
+		secretMap[filename] = *secret
+	}
+	return secretMap, nil
+}
+
+// vaultListKeys extracts the "keys" field from a Vault list response.
+func vaultListKeys(resp *vaultapi.Secret) ([]string, error) {
+	if resp == nil {
+		return nil, nil
+	}
+	raw, ok := resp.Data["keys"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected vault list response: missing 'keys'")
+	}
+	keys := make([]string, 0, len(raw))
+	for _, k := range raw {
+		s, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected vault list response: non-string key %v", k)
+		}
+		keys = append(keys, s)
+	}
+	return keys, nil
+}
+
+// vaultSecretSoftDeleted reports whether resp is a KV v2 response for a version that has
+// been soft-deleted or destroyed. Vault returns a non-nil response with an empty
+// "data.data" map in that case, rather than a nil response like a truly absent secret,
+// so this must be checked in addition to resp == nil.
+func vaultSecretSoftDeleted(resp *vaultapi.Secret) bool {
+	inner, ok := resp.Data["data"].(map[string]interface{})
+	return !ok || len(inner) == 0
+}
+
+// secretFromVaultResponse maps a KV v2 "data" read response into keysync's Secret struct.
+// The secret's name becomes the filename, the base64-encoded "value" key becomes the
+// content, and mode/owner/group are taken from custom_metadata when present.
+func secretFromVaultResponse(name string, resp *vaultapi.Secret) (*Secret, error) {
+	inner, ok := resp.Data["data"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("vault response for %v missing 'data'", name)
+	}
+	value, ok := inner["value"].(string)
+	if !ok {
+		return nil, fmt.Errorf("vault response for %v missing 'value'", name)
+	}
+	content, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("value for %v is not valid base64: %v", name, err)
+	}
+
+	secret := &Secret{
+		Name:    name,
+		Content: content,
+	}
+
+	if meta, ok := resp.Data["metadata"].(map[string]interface{}); ok {
+		if custom, ok := meta["custom_metadata"].(map[string]interface{}); ok {
+			if mode, ok := custom["mode"].(string); ok {
+				secret.Mode = mode
+			}
+			if owner, ok := custom["owner"].(string); ok {
+				secret.Owner = owner
+			}
+			if group, ok := custom["group"].(string); ok {
+				secret.Group = group
+			}
+		}
+	}
+
+	return secret, nil
+}